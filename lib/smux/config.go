@@ -0,0 +1,110 @@
+package smux
+
+import (
+	"errors"
+	"time"
+)
+
+// Config is used to tune the Smux session
+type Config struct {
+	// KeepAliveInterval is how often to send a NOP ping to the peer
+	KeepAliveInterval time.Duration
+
+	// KeepAliveTimeout is how long to wait for any traffic before closing
+	// the connection
+	KeepAliveTimeout time.Duration
+
+	// MaxFrameSize is the maximum size of a single frame payload. Capped
+	// at 65535 on protocol v1, whose wire length field is a uint16; v2's
+	// wider uint32 length field allows jumbo frames above that, up to
+	// maxFrameSizeV2.
+	MaxFrameSize int
+
+	// MaxReceiveBuffer is the per-session token bucket, in bytes, that
+	// bounds how much unread data the session will buffer before it
+	// stops reading from the underlying connection
+	MaxReceiveBuffer int
+
+	// MaxStreamBuffer is the per-stream receive buffer limit, in bytes
+	MaxStreamBuffer int
+
+	// EnableStreamBuffer enables acking of cmdNOP frames, used by callers
+	// that want a liveness/ack signal on top of the basic protocol
+	EnableStreamBuffer bool
+
+	// BoostTimeout bounds how long a stream write will block waiting for
+	// a paused peer to resume before giving up
+	BoostTimeout time.Duration
+
+	// WriteRequestQueueSize bounds how many writeRequests sendLoop's
+	// single priority queue may hold at once; once full, Stream.Write
+	// and other writeFrame callers block until the writer drains some of
+	// it. Zero or negative disables the bound. A single queue shared
+	// across all streams replaced the old per-stream queues, so this now
+	// caps total pending writes for the session rather than any one
+	// stream's share of them.
+	WriteRequestQueueSize int
+
+	// Version is the highest protocol version this session proposes
+	// during the startup handshake; the session settles on
+	// min(local Version, peer's Version). 1 is the original FUL/EMP
+	// pause-based protocol, 2 adds cmdUPD sliding-window flow control.
+	Version int
+
+	// EnableReordering requests per-stream frame sequence numbers and
+	// reassembly, for transports that may deliver frames out of order
+	// (e.g. multiple parallel sub-connections). It only takes effect if
+	// the peer also requests it and both sides settle on protocol
+	// version 2 or later; otherwise the session silently falls back to
+	// in-order delivery.
+	EnableReordering bool
+
+	// Test toggles the synchronous send path used by unit tests
+	Test bool
+}
+
+// DefaultConfig is used to return a default configuration
+func DefaultConfig() *Config {
+	return &Config{
+		KeepAliveInterval:     10 * time.Second,
+		KeepAliveTimeout:      30 * time.Second,
+		MaxFrameSize:          4096,
+		MaxReceiveBuffer:      4194304,
+		MaxStreamBuffer:       65536,
+		WriteRequestQueueSize: 128,
+		Version:               maxVersion,
+	}
+}
+
+// VerifyConfig is used to verify the sanity of configuration
+func VerifyConfig(config *Config) error {
+	if config.KeepAliveInterval <= 0 {
+		return errors.New("keep-alive interval must be positive")
+	}
+	if config.KeepAliveTimeout <= 0 {
+		return errors.New("keep-alive timeout must be positive")
+	}
+	if config.KeepAliveTimeout < config.KeepAliveInterval {
+		return errors.New("keep-alive timeout must be larger than keep-alive interval")
+	}
+	if config.MaxFrameSize <= 0 {
+		return errors.New("max frame size must be positive")
+	}
+	if config.Version >= 2 {
+		if config.MaxFrameSize > maxFrameSizeV2 {
+			return errors.New("max frame size must not be larger than 16MiB on protocol v2")
+		}
+	} else if config.MaxFrameSize > 65535 {
+		return errors.New("max frame size must not be larger than 65535 on protocol v1")
+	}
+	if config.MaxReceiveBuffer <= 0 {
+		return errors.New("max receive buffer must be positive")
+	}
+	if config.MaxStreamBuffer <= 0 {
+		return errors.New("max stream buffer must be positive")
+	}
+	if config.Version < 1 || config.Version > maxVersion {
+		return errors.New("unsupported protocol version")
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package smux
+
+import "testing"
+
+// TestVerifyConfigFrameSizeCapByVersion checks that MaxFrameSize's upper
+// bound depends on the negotiated protocol version: v1's wire length
+// field is a uint16, while v2's wider uint32 field allows jumbo frames up
+// to maxFrameSizeV2.
+func TestVerifyConfigFrameSizeCapByVersion(t *testing.T) {
+	cases := []struct {
+		name         string
+		version      int
+		maxFrameSize int
+		wantErr      bool
+	}{
+		{"v1 at the uint16 limit", 1, 65535, false},
+		{"v1 over the uint16 limit", 1, 65536, true},
+		{"v2 above the v1 limit", 2, 1 << 20, false},
+		{"v2 at maxFrameSizeV2", 2, maxFrameSizeV2, false},
+		{"v2 over maxFrameSizeV2", 2, maxFrameSizeV2 + 1, true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			config := DefaultConfig()
+			config.Version = tc.version
+			config.MaxFrameSize = tc.maxFrameSize
+
+			err := VerifyConfig(config)
+			if tc.wantErr && err == nil {
+				t.Fatalf("VerifyConfig(version=%d, MaxFrameSize=%d) = nil error, want one", tc.version, tc.maxFrameSize)
+			}
+			if !tc.wantErr && err != nil {
+				t.Fatalf("VerifyConfig(version=%d, MaxFrameSize=%d) = %v, want nil", tc.version, tc.maxFrameSize, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,150 @@
+package smux
+
+import "encoding/binary"
+
+// maxVersion is the highest protocol version this build understands.
+// Session.version holds whatever was actually negotiated with the peer.
+const maxVersion = 2
+
+// maxFrameSizeV2 bounds Config.MaxFrameSize on protocol v2, where the
+// wire length field is a uint32 wide enough to carry far more than this -
+// it's a sanity limit on top of what the wire format allows, not the
+// format's own ceiling, so recvLoop/sendLoop's per-session buffers stay
+// a reasonable size.
+const maxFrameSizeV2 = 16 * 1024 * 1024
+
+// cmds
+const (
+	cmdSYN byte = iota // stream open
+	cmdFIN             // stream close, a.k.a EOF mark
+	cmdPSH             // data push
+	cmdNOP             // no operation, used for keep-alive
+	cmdFUL             // stream recv buffer is full, pause peer write (v1)
+	cmdEMP             // stream recv buffer is no longer full, resume peer write (v1)
+	cmdACK             // ack for cmdNOP, carries rtt measurement
+	cmdUPD             // sliding-window update: bytes consumed + advertised window (v2+)
+	cmdVER             // protocol version handshake, sid always 0
+)
+
+// numCmds bounds the per-cmd frame counters kept by SessionStats
+const numCmds = int(cmdVER) + 1
+
+const (
+	sizeOfVer      = 1
+	sizeOfCmd      = 1
+	sizeOfSid      = 4
+	sizeOfLengthV1 = 2
+	sizeOfLengthV2 = 4
+	sizeOfSeq      = 4
+
+	// headerSizeV1 is the wire layout for protocol version 1:
+	// ver(1) cmd(1) length-u16(2) sid(4)
+	headerSizeV1 = sizeOfVer + sizeOfCmd + sizeOfLengthV1 + sizeOfSid
+
+	// headerSizeV2 widens the length field to a u32 so v2 frames can
+	// carry jumbo payloads: ver(1) cmd(1) length-u32(4) sid(4)
+	headerSizeV2 = sizeOfVer + sizeOfCmd + sizeOfLengthV2 + sizeOfSid
+
+	// headerSizeV2Seq is headerSizeV2 plus the 4-byte seq field carried
+	// by cmdPSH frames when the session has reordering enabled
+	headerSizeV2Seq = headerSizeV2 + sizeOfSeq
+
+	// maxHeaderSize bounds scratch buffers that must fit any version's header
+	maxHeaderSize = headerSizeV2Seq
+)
+
+// Frame defines a packet from or to be multiplexed into a single connection
+type Frame struct {
+	ver  byte
+	cmd  byte
+	sid  uint32
+	data []byte
+
+	// seq is a per-stream, per-direction monotonic sequence number
+	// carried by cmdPSH frames when the session has reordering enabled
+	// (see Config.EnableReordering); zero and unused otherwise
+	seq uint32
+}
+
+// newFrame builds a frame tagged with an explicit protocol version, so a
+// single binary can keep v1 and v2 peers on the wire format each expects.
+func newFrame(ver byte, cmd byte, sid uint32) Frame {
+	return Frame{ver: ver, cmd: cmd, sid: sid}
+}
+
+// newVersionFrame builds the handshake frame used to negotiate a protocol
+// version and whether per-stream frame reordering is requested. It always
+// travels in the v1 wire format, since the negotiated version isn't known
+// until the handshake completes.
+func newVersionFrame(proposed byte, reordering bool) Frame {
+	f := newFrame(1, cmdVER, 0)
+	f.data = []byte{proposed, 0}
+	if reordering {
+		f.data[1] = 1
+	}
+	return f
+}
+
+// newUpdateFrame builds a cmdUPD frame reporting how many bytes the
+// local side has consumed and how large a window it currently advertises
+func newUpdateFrame(ver byte, sid uint32, consumed, window uint32) Frame {
+	f := newFrame(ver, cmdUPD, sid)
+	f.data = make([]byte, 8)
+	binary.LittleEndian.PutUint32(f.data[0:], consumed)
+	binary.LittleEndian.PutUint32(f.data[4:], window)
+	return f
+}
+
+// headerLen returns the wire header length for a frame with the given
+// version and command. reordering must reflect the session's negotiated
+// Config.EnableReordering state, since only then does a cmdPSH frame
+// carry the extra seq field.
+func headerLen(ver, cmd byte, reordering bool) int {
+	if ver < 2 {
+		return headerSizeV1
+	}
+	if cmd == cmdPSH && reordering {
+		return headerSizeV2Seq
+	}
+	return headerSizeV2
+}
+
+// encodeHeader writes f's header into buf, which must be at least
+// headerLen(f.ver, f.cmd, reordering) bytes long, and returns how many
+// bytes it used.
+func encodeHeader(buf []byte, f Frame, reordering bool) int {
+	buf[0] = f.ver
+	buf[1] = f.cmd
+	if f.ver >= 2 {
+		binary.LittleEndian.PutUint32(buf[2:], uint32(len(f.data)))
+		binary.LittleEndian.PutUint32(buf[6:], f.sid)
+		if f.cmd == cmdPSH && reordering {
+			binary.LittleEndian.PutUint32(buf[10:], f.seq)
+			return headerSizeV2Seq
+		}
+		return headerSizeV2
+	}
+	binary.LittleEndian.PutUint16(buf[2:], uint16(len(f.data)))
+	binary.LittleEndian.PutUint32(buf[4:], f.sid)
+	return headerSizeV1
+}
+
+// decodeHeader parses a header previously written by encodeHeader. The
+// version and command bytes alone determine the layout of everything
+// after them, so callers can self-describe the frame without consulting
+// session state beyond the negotiated reordering flag.
+func decodeHeader(buf []byte, reordering bool) (ver, cmd byte, sid uint32, length uint32, seq uint32) {
+	ver = buf[0]
+	cmd = buf[1]
+	if ver >= 2 {
+		length = binary.LittleEndian.Uint32(buf[2:])
+		sid = binary.LittleEndian.Uint32(buf[6:])
+		if cmd == cmdPSH && reordering {
+			seq = binary.LittleEndian.Uint32(buf[10:])
+		}
+	} else {
+		length = uint32(binary.LittleEndian.Uint16(buf[2:]))
+		sid = binary.LittleEndian.Uint32(buf[4:])
+	}
+	return
+}
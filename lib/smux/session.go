@@ -1,12 +1,12 @@
 package smux
 
 import (
-	"encoding/binary"
+	"container/heap"
 	"io"
+	"net"
 	"sync"
 	"sync/atomic"
 	"time"
-	"sort"
 
 	"errors"
 )
@@ -19,10 +19,12 @@ const (
 	errBrokenPipe      = "broken pipe"
 	errInvalidProtocol = "invalid protocol version"
 	errGoAway          = "stream id overflows, should start a new connection"
+	errFrameTooLarge   = "frame length exceeds buffer capacity"
 )
 
 type writeRequest struct {
 	frame  Frame
+	prio   uint64
 	result chan writeResult
 }
 
@@ -31,6 +33,49 @@ type writeResult struct {
 	err error
 }
 
+// priority classes for frame scheduling: control frames are scheduled
+// ahead of bulk data regardless of how long the data queue has grown
+const (
+	prioControl uint64 = 0
+	prioData    uint64 = 1 << 32
+)
+
+// pqItem wraps a writeRequest for use in the sendLoop's priority queue
+type pqItem struct {
+	req   writeRequest
+	index int
+}
+
+// priorityQueue is a container/heap min-heap of pending writes, ordered
+// by writeRequest.prio
+type priorityQueue []*pqItem
+
+func (pq priorityQueue) Len() int { return len(pq) }
+
+func (pq priorityQueue) Less(i, j int) bool { return pq[i].req.prio < pq[j].req.prio }
+
+func (pq priorityQueue) Swap(i, j int) {
+	pq[i], pq[j] = pq[j], pq[i]
+	pq[i].index = i
+	pq[j].index = j
+}
+
+func (pq *priorityQueue) Push(x interface{}) {
+	item := x.(*pqItem)
+	item.index = len(*pq)
+	*pq = append(*pq, item)
+}
+
+func (pq *priorityQueue) Pop() interface{} {
+	old := *pq
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	item.index = -1
+	*pq = old[:n-1]
+	return item
+}
+
 // Session defines a multiplexed connection for streams
 type Session struct {
 	conn io.ReadWriteCloser
@@ -64,9 +109,37 @@ type Session struct {
 
 	WriteRequestQueueSize int
 
-	rttSn uint32
-	rttTest time.Time
-	rtt time.Duration
+	rttSn   uint32
+	rttTest atomic.Value // time.Time; set by keepalive, read by recvLoop's cmdACK case
+	rtt     time.Duration
+	rttEWMA int64 // time.Duration nanoseconds, atomic access only
+
+	startTime time.Time
+
+	bytesIn   uint64
+	bytesOut  uint64
+	framesIn  [numCmds]uint64
+	framesOut [numCmds]uint64
+
+	seq uint64 // monotonically increasing, used to order queued writes
+
+	// version is the protocol version negotiated with the peer at
+	// startup; it gates cmdUPD-based sliding-window flow control (v2+)
+	// versus the legacy cmdFUL/cmdEMP pause/resume scheme (v1). It's
+	// written once from recvLoop (via negotiatePeerVersion) but read from
+	// sendLoop, keepalive, and every Stream, so it's atomic rather than a
+	// plain int.
+	version atomic.Int32
+	client  bool
+
+	// reordering is whether this session settled on per-stream frame
+	// sequencing/reassembly during the startup handshake; see
+	// Config.EnableReordering. Same cross-goroutine read/write pattern as
+	// version, so it's atomic too.
+	reordering atomic.Bool
+
+	verOnce sync.Once
+	verDone chan struct{}
 
 	test bool
 }
@@ -93,6 +166,11 @@ func newSession(config *Config, conn io.ReadWriteCloser, client bool) *Session {
 //	s.test = true
 //	s.test = false
 
+	s.version.Store(1)
+	s.client = client
+	s.verDone = make(chan struct{})
+	s.startTime = time.Now()
+
 	if client {
 		s.nextStreamID = 1
 	} else {
@@ -101,9 +179,70 @@ func newSession(config *Config, conn io.ReadWriteCloser, client bool) *Session {
 	go s.recvLoop()
 	go s.sendLoop()
 	go s.keepalive()
+
+	if client {
+		s.negotiateVersion()
+	}
 	return s
 }
 
+// negotiateVersion performs a lightweight startup handshake so this
+// session settles on a protocol version both sides understand, and on
+// whether per-stream frame reordering is active: the client proposes its
+// highest supported version and its EnableReordering preference in a
+// cmdVER frame, and the server replies with min(client, server) version
+// plus the AND of both sides' reordering preference. It always travels
+// in the v1 wire format, since the negotiated version isn't known until
+// it completes. OpenStream/Write are only reachable after this returns,
+// so no real traffic is sent in the wrong format.
+func (s *Session) negotiateVersion() {
+	s.writeFrame(newVersionFrame(byte(s.config.Version), s.config.EnableReordering))
+
+	select {
+	case <-s.verDone:
+	case <-time.After(s.config.KeepAliveTimeout):
+	case <-s.die:
+	}
+}
+
+// negotiatePeerVersion processes one side of the cmdVER handshake. The
+// server computes min(peerVersion, its own Version), ANDs the two sides'
+// reordering preference (dropping it if the negotiated version can't
+// carry a seq field), and echoes both back; the client just adopts
+// whatever the server already settled on. Guarded by verOnce so a cmdVER
+// that arrives after the handshake has already completed - whether from
+// a confused peer or a replay - is ignored instead of live-desyncing
+// frame encoding/decoding from whatever traffic is already in flight.
+func (s *Session) negotiatePeerVersion(peerVersion int, peerReordering bool) {
+	s.verOnce.Do(func() {
+		if s.client {
+			s.version.Store(int32(peerVersion))
+			s.reordering.Store(peerReordering)
+			close(s.verDone)
+			return
+		}
+
+		negotiated := s.config.Version
+		if peerVersion < negotiated {
+			negotiated = peerVersion
+		}
+		if negotiated < 1 {
+			negotiated = 1
+		}
+		reordering := negotiated >= 2 && s.config.EnableReordering && peerReordering
+		s.version.Store(int32(negotiated))
+		s.reordering.Store(reordering)
+		close(s.verDone)
+		// writeFrame blocks until the frame is actually flushed to the
+		// peer, which in turn requires the peer's recvLoop to be
+		// reading. Since we're running on this session's own recvLoop
+		// goroutine, waiting here would deadlock against a peer whose
+		// recvLoop is doing the same thing at the same time, so fire
+		// the reply off the hot path.
+		go s.writeFrame(newVersionFrame(byte(negotiated), reordering))
+	})
+}
+
 // OpenStream is used to create a new stream
 func (s *Session) OpenStream() (*Stream, error) {
 	if s.IsClosed() {
@@ -128,7 +267,7 @@ func (s *Session) OpenStream() (*Stream, error) {
 
 	stream := newStream(sid, s.config.MaxFrameSize, s)
 
-	if _, err := s.writeFrame(newFrame(cmdSYN, sid)); err != nil {
+	if _, err := s.writeFrame(newFrame(byte(s.version.Load()), cmdSYN, sid)); err != nil {
 		return nil, errors.New("writeFrame: " + err.Error())
 	}
 
@@ -206,6 +345,90 @@ func (s *Session) NumStreams() int {
 	return len(s.streams)
 }
 
+// rttEWMAWeight is the smoothing factor for RTT's exponentially-weighted
+// moving average, matching the classic TCP SRTT gain
+const rttEWMAWeight = 0.125
+
+// updateRTTEWMA folds a fresh RTT sample (from a cmdNOP/cmdACK
+// round-trip) into the running average returned by RTT.
+func (s *Session) updateRTTEWMA(sample time.Duration) {
+	for {
+		old := atomic.LoadInt64(&s.rttEWMA)
+		next := int64(sample)
+		if old != 0 {
+			next = int64(float64(old)*(1-rttEWMAWeight) + float64(sample)*rttEWMAWeight)
+		}
+		if atomic.CompareAndSwapInt64(&s.rttEWMA, old, next) {
+			return
+		}
+	}
+}
+
+// RTT returns an exponentially-weighted moving average of the round-trip
+// times measured by the keepalive cmdNOP/cmdACK exchange. It is zero
+// until the first sample arrives.
+func (s *Session) RTT() time.Duration {
+	return time.Duration(atomic.LoadInt64(&s.rttEWMA))
+}
+
+// bandwidth estimates the session's outbound throughput in bytes/sec
+// from total bytes written over the session's lifetime so far.
+func (s *Session) bandwidth() float64 {
+	elapsed := time.Since(s.startTime).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(atomic.LoadUint64(&s.bytesOut)) / elapsed
+}
+
+// initialPeerWindow sizes a new stream's assumed peer window as the
+// bandwidth-delay product (bandwidth * RTT) once both are known, so a
+// fast, high-latency link isn't throttled down to defaultStreamWindow.
+// Falls back to defaultStreamWindow before the session has measured
+// either quantity.
+func (s *Session) initialPeerWindow() uint32 {
+	rtt := s.RTT()
+	bw := s.bandwidth()
+	if rtt <= 0 || bw <= 0 {
+		return defaultStreamWindow
+	}
+	if w := uint32(bw * rtt.Seconds()); w > defaultStreamWindow {
+		return w
+	}
+	return defaultStreamWindow
+}
+
+// SessionStats is a point-in-time snapshot of a session's traffic
+// counters, suitable for wiring into a metrics system such as
+// Prometheus.
+type SessionStats struct {
+	BytesIn     uint64
+	BytesOut    uint64
+	FramesIn    map[byte]uint64 // keyed by cmd, e.g. cmdPSH
+	FramesOut   map[byte]uint64 // keyed by cmd, e.g. cmdPSH
+	RTT         time.Duration
+	NumStreams  int
+	BucketLevel int32
+}
+
+// Stats returns a snapshot of this session's traffic counters.
+func (s *Session) Stats() SessionStats {
+	stats := SessionStats{
+		BytesIn:     atomic.LoadUint64(&s.bytesIn),
+		BytesOut:    atomic.LoadUint64(&s.bytesOut),
+		FramesIn:    make(map[byte]uint64, numCmds),
+		FramesOut:   make(map[byte]uint64, numCmds),
+		RTT:         s.RTT(),
+		NumStreams:  s.NumStreams(),
+		BucketLevel: atomic.LoadInt32(&s.bucket),
+	}
+	for cmd := 0; cmd < numCmds; cmd++ {
+		stats.FramesIn[byte(cmd)] = atomic.LoadUint64(&s.framesIn[cmd])
+		stats.FramesOut[byte(cmd)] = atomic.LoadUint64(&s.framesOut[cmd])
+	}
+	return stats
+}
+
 // SetDeadline sets a deadline used by Accept* calls.
 // A zero time value disables the deadline.
 func (s *Session) SetDeadline(t time.Time) error {
@@ -234,31 +457,53 @@ func (s *Session) returnTokens(n int) {
 
 // session read a frame from underlying connection
 // it's data is pointed to the input buffer
+//
+// The version and command bytes are always first on the wire, so they're
+// read on their own and used to pick the rest of the header's layout
+// (see headerLen) before the frame is otherwise interpreted off
+// Session.version/reordering: a cmdPSH frame only carries the extra seq
+// field when this session negotiated reordering.
 func (s *Session) readFrame(buffer []byte) (f Frame, err error) {
-	if _, err := io.ReadFull(s.conn, buffer[:headerSize]); err != nil {
+	if _, err := io.ReadFull(s.conn, buffer[:2]); err != nil {
 		return f, errors.New("readFrame: " + err.Error())
 	}
 
-	dec := rawHeader(buffer)
-	if dec.Version() != version {
+	ver := buffer[0]
+	cmd := buffer[1]
+	if ver < 1 || int(ver) > maxVersion {
 		return f, errors.New(errInvalidProtocol)
 	}
 
-	f.ver = dec.Version()
-	f.cmd = dec.Cmd()
-	f.sid = dec.StreamID()
-	if length := dec.Length(); length > 0 {
-		if _, err := io.ReadFull(s.conn, buffer[headerSize:headerSize+length]); err != nil {
+	hdrLen := headerLen(ver, cmd, s.reordering.Load())
+	if _, err := io.ReadFull(s.conn, buffer[2:hdrLen]); err != nil {
+		return f, errors.New("readFrame: " + err.Error())
+	}
+
+	_, _, sid, length, seq := decodeHeader(buffer[:hdrLen], s.reordering.Load())
+	f.ver = ver
+	f.cmd = cmd
+	f.sid = sid
+	f.seq = seq
+	if length > 0 {
+		// length is peer-controlled and, under the v2 wire format, a
+		// full uint32 - well beyond what buffer (sized off MaxFrameSize)
+		// actually has room for. Check before indexing into it, or a
+		// corrupted/desynced/hostile peer panics the whole recvLoop
+		// goroutine instead of just failing its own session.
+		if hdrLen+int(length) > len(buffer) {
+			return f, errors.New(errFrameTooLarge)
+		}
+		if _, err := io.ReadFull(s.conn, buffer[hdrLen:hdrLen+int(length)]); err != nil {
 			return f, errors.New("readFrame: " + err.Error())
 		}
-		f.data = buffer[headerSize : headerSize+length]
+		f.data = buffer[hdrLen : hdrLen+int(length)]
 	}
 	return f, nil
 }
 
 // recvLoop keeps on reading from underlying connection if tokens are available
 func (s *Session) recvLoop() {
-	buffer := make([]byte, (1<<16)+headerSize)
+	buffer := make([]byte, s.config.MaxFrameSize+maxHeaderSize)
 	for {
 		for atomic.LoadInt32(&s.bucket) <= 0 && !s.IsClosed() {
 			<-s.bucketNotify
@@ -266,11 +511,15 @@ func (s *Session) recvLoop() {
 
 		if f, err := s.readFrame(buffer); err == nil {
 			atomic.StoreInt32(&s.dataReady, 1)
+			atomic.AddUint64(&s.bytesIn, uint64(len(f.data)))
+			atomic.AddUint64(&s.framesIn[f.cmd], 1)
 
 			switch f.cmd {
 			case cmdNOP:
 				if s.EnableStreamBuffer {
-					s.writeFrame(newFrame(cmdACK, f.sid))
+					// see the comment in negotiatePeerVersion: this must
+					// not block the recvLoop goroutine that's reading it
+					go s.writeFrame(newFrame(byte(s.version.Load()), cmdACK, f.sid))
 				}
 			case cmdSYN:
 				s.streamLock.Lock()
@@ -292,12 +541,20 @@ func (s *Session) recvLoop() {
 				s.streamLock.Unlock()
 			case cmdPSH:
 				s.streamLock.Lock()
-				if stream, ok := s.streams[f.sid]; ok {
+				stream, ok := s.streams[f.sid]
+				s.streamLock.Unlock()
+				if ok {
 					atomic.AddInt32(&s.bucket, -int32(len(f.data)))
-					stream.pushBytes(f.data)
+					if s.reordering.Load() {
+						if err := stream.pushSeq(f.seq, f.data); err != nil {
+							s.Close()
+							return
+						}
+					} else {
+						stream.pushBytes(f.data)
+					}
 					stream.notifyReadEvent()
 				}
-				s.streamLock.Unlock()
 			case cmdFUL:
 				s.streamLock.Lock()
 				if stream, ok := s.streams[f.sid]; ok {
@@ -313,7 +570,24 @@ func (s *Session) recvLoop() {
 				s.streamLock.Unlock()
 			case cmdACK:
 				if f.sid == atomic.LoadUint32(&s.rttSn) {
-					s.rtt = time.Now().Sub(s.rttTest) + 1
+					sample := time.Now().Sub(s.rttTest.Load().(time.Time)) + 1
+					s.rtt = sample
+					s.updateRTTEWMA(sample)
+				}
+			case cmdUPD:
+				s.streamLock.Lock()
+				stream, ok := s.streams[f.sid]
+				s.streamLock.Unlock()
+				if ok {
+					if err := stream.updatePeerWindow(f.data); err != nil {
+						s.Close()
+						return
+					}
+				}
+			case cmdVER:
+				if len(f.data) > 0 {
+					reordering := len(f.data) > 1 && f.data[1] != 0
+					s.negotiatePeerVersion(int(f.data[0]), reordering)
 				}
 			default:
 				s.Close()
@@ -326,21 +600,44 @@ func (s *Session) recvLoop() {
 	}
 }
 
+// nextKeepAliveInterval picks how long to wait before the next keepalive
+// ping. Once RTT samples are available it shrinks to 4*RTT whenever that
+// is below KeepAliveInterval (so a low-latency link pings more often,
+// while a high-latency one stays at KeepAliveInterval), and the result is
+// clamped to [KeepAliveTimeout/8, KeepAliveTimeout/2] so it never
+// drifts past what KeepAliveTimeout can tolerate.
+func (s *Session) nextKeepAliveInterval() time.Duration {
+	interval := s.config.KeepAliveInterval
+	if rtt := s.RTT(); rtt > 0 {
+		if adaptive := rtt * 4; adaptive < interval {
+			interval = adaptive
+		}
+	}
+	if min := s.config.KeepAliveTimeout / 8; interval < min {
+		interval = min
+	}
+	if max := s.config.KeepAliveTimeout / 2; interval > max {
+		interval = max
+	}
+	return interval
+}
+
 func (s *Session) keepalive() {
-	tickerPing := time.NewTicker(s.config.KeepAliveInterval)
+	timerPing := time.NewTimer(s.config.KeepAliveInterval)
 	tickerTimeout := time.NewTicker(s.config.KeepAliveTimeout)
-	defer tickerPing.Stop()
+	defer timerPing.Stop()
 	defer tickerTimeout.Stop()
 
-	s.rttTest = time.Now()
-	s.writeFrame(newFrame(cmdNOP, atomic.AddUint32(&s.rttSn, uint32(1))))
+	s.rttTest.Store(time.Now())
+	s.writeFrame(newFrame(byte(s.version.Load()), cmdNOP, atomic.AddUint32(&s.rttSn, uint32(1))))
 
 	for {
 		select {
-		case <-tickerPing.C:
-			s.rttTest = time.Now()
-			s.writeFrame(newFrame(cmdNOP, atomic.AddUint32(&s.rttSn, uint32(1))))
+		case <-timerPing.C:
+			s.rttTest.Store(time.Now())
+			s.writeFrame(newFrame(byte(s.version.Load()), cmdNOP, atomic.AddUint32(&s.rttSn, uint32(1))))
 			s.notifyBucket() // force a signal to the recvLoop
+			timerPing.Reset(s.nextKeepAliveInterval())
 		case <-tickerTimeout.C:
 			if !atomic.CompareAndSwapInt32(&s.dataReady, 1, 0) {
 				s.Close()
@@ -352,197 +649,217 @@ func (s *Session) keepalive() {
 	}
 }
 
+// maxBatchWrites bounds how many queued writeRequests sendLoop will fold
+// into one net.Buffers.WriteTo call
+const maxBatchWrites = 32
+
+// headerSlab holds the wire headers for a batch of writeRequests, so
+// batching many small PSH frames doesn't force a per-frame allocation.
+// Sized for the widest header any supported version can produce.
+type headerSlab [maxBatchWrites][maxHeaderSize]byte
+
+// doWrite marshals a single writeRequest onto the wire and delivers the
+// result back to the caller blocked on writeFrame/writeFrameInternal
+func (s *Session) doWrite(buf []byte, request writeRequest) {
+	hdrLen := encodeHeader(buf, request.frame, s.reordering.Load())
+	copy(buf[hdrLen:], request.frame.data)
+	n, err := s.conn.Write(buf[:hdrLen+len(request.frame.data)])
+
+	n -= hdrLen
+	if n < 0 {
+		n = 0
+	}
+	atomic.AddUint64(&s.bytesOut, uint64(n))
+	atomic.AddUint64(&s.framesOut[request.frame.cmd], 1)
+
+	request.result <- writeResult{n: n, err: err}
+	close(request.result)
+}
+
+// doWriteBatch flushes several writeRequests via net.Buffers.WriteTo -
+// which folds them into a single writev(2) syscall on connections that
+// support it (e.g. *net.TCPConn), falling back to sequential Writes
+// otherwise - and fans the (approximate, in the rare partial-write case)
+// per-request result back out. reqs must be non-empty and len(reqs) <=
+// len(slab).
+func (s *Session) doWriteBatch(slab *headerSlab, reqs []writeRequest) {
+	v := make(net.Buffers, 0, len(reqs)*2)
+	hdrLens := make([]int, len(reqs))
+	for i, req := range reqs {
+		h := slab[i][:]
+		hdrLens[i] = encodeHeader(h, req.frame, s.reordering.Load())
+		v = append(v, h[:hdrLens[i]])
+		if len(req.frame.data) > 0 {
+			v = append(v, req.frame.data)
+		}
+	}
+
+	written, err := v.WriteTo(s.conn)
+
+	remaining := int(written)
+	for i, req := range reqs {
+		frameLen := hdrLens[i] + len(req.frame.data)
+		var n int
+		var reqErr error
+		switch {
+		case remaining >= frameLen:
+			n = len(req.frame.data)
+			remaining -= frameLen
+		case remaining > hdrLens[i]:
+			n = remaining - hdrLens[i]
+			remaining = 0
+			reqErr = err
+		default:
+			remaining = 0
+			reqErr = err
+		}
+		atomic.AddUint64(&s.bytesOut, uint64(n))
+		atomic.AddUint64(&s.framesOut[req.frame.cmd], 1)
+		req.result <- writeResult{n: n, err: reqErr}
+		close(req.result)
+	}
+}
+
+// sendLoop drains queued writes onto the underlying connection. Pending
+// writes sit in a single priority queue (a container/heap min-heap keyed
+// on writeRequest.prio) instead of per-stream FIFOs, so the writer never
+// has to scan every stream looking for work: it just pops the smallest
+// priority. Control frames are assigned a low, fixed priority so they
+// always jump ahead of queued bulk data. The queue is capped at
+// Config.WriteRequestQueueSize: once full, writeFrame/writeFrameInternal
+// callers block until the writer drains it, the same backpressure the
+// old per-stream FIFOs provided.
 func (s *Session) sendLoop() {
-	buf := make([]byte, (1<<16)+headerSize)
-
-	var queueLock sync.Mutex
-	QueueSize := s.WriteRequestQueueSize
-	streamQueues := make(map[uint32](chan writeRequest))
-	writeNotify := make(chan struct{}, 1)
-	var reqCount int32 = 0
-	writes := make(chan writeRequest)
-if !s.test {
-	writes = make(chan writeRequest, 32)
-	go func() {
+	buf := make([]byte, s.config.MaxFrameSize+maxHeaderSize)
+
+	if s.test {
 		for {
 			select {
 			case <-s.die:
 				return
-			case request, ok := <-writes:
+			case request, ok := <-s.writes:
 				if !ok {
 					continue
 				}
+				s.doWrite(buf, request)
+			}
+		}
+	}
 
-				buf[0] = request.frame.ver
-				buf[1] = request.frame.cmd
-				binary.LittleEndian.PutUint16(buf[2:], uint16(len(request.frame.data)))
-				binary.LittleEndian.PutUint32(buf[4:], request.frame.sid)
-				copy(buf[headerSize:], request.frame.data)
-				n, err := s.conn.Write(buf[:headerSize+len(request.frame.data)])
+	var pqLock sync.Mutex
+	pq := &priorityQueue{}
+	heap.Init(pq)
+	notify := make(chan struct{}, 1)
+	spaceFreed := make(chan struct{}, 1)
 
-				n -= headerSize
-				if n < 0 {
-					n = 0
+	go func() {
+		var slab headerSlab
+		for {
+			pqLock.Lock()
+			for pq.Len() == 0 {
+				pqLock.Unlock()
+				select {
+				case <-s.die:
+					return
+				case <-notify:
 				}
+				pqLock.Lock()
+			}
 
-				result := writeResult{
-					n:   n,
-					err: err,
+			if pq.Len() == 1 {
+				item := heap.Pop(pq).(*pqItem)
+				pqLock.Unlock()
+				s.doWrite(buf, item.req)
+				select {
+				case spaceFreed <- struct{}{}:
+				default:
 				}
+				continue
+			}
 
-				request.result <- result
-				close(request.result)
+			n := pq.Len()
+			if n > maxBatchWrites {
+				n = maxBatchWrites
 			}
-		}
-	}()
+			reqs := make([]writeRequest, n)
+			for i := 0; i < n; i++ {
+				reqs[i] = heap.Pop(pq).(*pqItem).req
+			}
+			pqLock.Unlock()
 
-	go func() {
-		for {
+			s.doWriteBatch(&slab, reqs)
 			select {
-			case <-s.die:
-				return
-			case <-writeNotify:
-				for atomic.LoadInt32(&reqCount) > 0 {
-					sids := make([]uint32, 0)
-					queueLock.Lock()
-					for sid, _ := range streamQueues {
-						sids = append(sids, sid)
-					}
-					queueLock.Unlock()
-
-					sort.Slice(sids, func(i, j int) bool { return sids[i] < sids[j] })
-
-					for _, sid := range sids {
-						queueLock.Lock()
-						if queue, ok := streamQueues[sid]; ok {
-							queueLock.Unlock()
-
-							select {
-							case request := <-queue:
-								if request.frame.cmd == cmdFIN {
-									queueLock.Lock()
-									delete(streamQueues, sid)
-									queueLock.Unlock()
-								}
-								writes <- request
-								atomic.AddInt32(&reqCount, -1)
-							default:
-							}
-						} else {
-							queueLock.Unlock()
-						}
-					}
-				}
+			case spaceFreed <- struct{}{}:
+			default:
 			}
 		}
 	}()
-}
 
 	for {
-		var request writeRequest
-		var ok bool
 		select {
 		case <-s.die:
 			return
-		case request, ok = <-s.writes:
+		case request, ok := <-s.writes:
 			if !ok {
 				continue
 			}
-			if s.test {
-				buf[0] = request.frame.ver
-				buf[1] = request.frame.cmd
-				binary.LittleEndian.PutUint16(buf[2:], uint16(len(request.frame.data)))
-				binary.LittleEndian.PutUint32(buf[4:], request.frame.sid)
-				copy(buf[headerSize:], request.frame.data)
-				n, err := s.conn.Write(buf[:headerSize+len(request.frame.data)])
-
-				n -= headerSize
-				if n < 0 {
-					n = 0
-				}
 
-				result := writeResult{
-					n:   n,
-					err: err,
+			// Back off until the queue has room rather than letting an
+			// outpacing producer (e.g. a Stream.Write under the v1
+			// FUL/EMP path, which only reacts once the peer is already
+			// full) grow the heap without bound.
+			for {
+				pqLock.Lock()
+				full := s.WriteRequestQueueSize > 0 && pq.Len() >= s.WriteRequestQueueSize
+				pqLock.Unlock()
+				if !full {
+					break
 				}
-
-				request.result <- result
-				close(request.result)
-				continue
-			}
-
-			f := request.frame
-			switch f.cmd {
-			case cmdSYN:
-				queueLock.Lock()
-				queue, ok := streamQueues[f.sid]
-				if !ok {
-					queue = make(chan writeRequest, QueueSize)
-					streamQueues[f.sid] = queue
-				}
-				queueLock.Unlock()
-
-				queue <- request
-				atomic.AddInt32(&reqCount, 1)
-
-			case cmdFIN:
-				queueLock.Lock()
-				if queue, ok := streamQueues[f.sid]; ok {
-					queueLock.Unlock()
-
-					select {
-					case queue <- request:
-						atomic.AddInt32(&reqCount, 1)
-					default:
-						// queue full
-						request2 := <-queue
-						queue <- request
-						writes <- request2
-					}
-				} else {
-					queueLock.Unlock()
-					writes <- request
-				}
-
-			case cmdPSH:
-				queueLock.Lock()
-				queue, ok := streamQueues[f.sid]
-				if !ok {
-					queue = make(chan writeRequest, QueueSize)
-					streamQueues[f.sid] = queue
-				}
-				queueLock.Unlock()
-
 				select {
-				case queue <- request:
-					atomic.AddInt32(&reqCount, 1)
-				default:
-					// queue full
-					request2 := <-queue
-					queue <- request
-					writes <- request2
+				case <-s.die:
+					return
+				case <-spaceFreed:
 				}
-
-			default:
-				writes <- request
-				continue
 			}
 
+			pqLock.Lock()
+			heap.Push(pq, &pqItem{req: request})
+			pqLock.Unlock()
+
 			select {
-			case writeNotify <- struct{}{}:
+			case notify <- struct{}{}:
 			default:
 			}
-
 		}
+	}
+}
 
+// framePriority assigns a scheduling priority to a frame. Control frames
+// (SYN/FIN/NOP/ACK/FUL/EMP) always get the prioControl class so they jump
+// ahead of queued bulk data; PSH frames get the prioData class ordered by
+// a monotonically increasing sequence number, so old frames of any stream
+// always drain before newer ones and no single stream can starve the rest.
+func (s *Session) framePriority(f Frame) uint64 {
+	seq := atomic.AddUint64(&s.seq, 1)
+	if f.cmd == cmdPSH {
+		return prioData + seq
 	}
+	return prioControl + seq
 }
 
 // writeFrame writes the frame to the underlying connection
 // and returns the number of bytes written if successful
 func (s *Session) writeFrame(f Frame) (n int, err error) {
+	return s.writeFrameInternal(f, s.framePriority(f))
+}
+
+// writeFrameInternal is like writeFrame but takes an explicit scheduling
+// priority, for callers that need finer QoS control than writeFrame's
+// frame-type-based defaults (e.g. keepalives, window updates).
+func (s *Session) writeFrameInternal(f Frame, prio uint64) (n int, err error) {
 	req := writeRequest{
 		frame:  f,
+		prio:   prio,
 		result: make(chan writeResult, 1),
 	}
 	select {
@@ -559,7 +876,7 @@ func (s *Session) WriteCustomCMD(cmd byte, bts []byte) (n int, err error) {
 	if s.IsClosed() {
 		return 0, errors.New(errBrokenPipe)
 	}
-	f := newFrame(cmd, 0)
+	f := newFrame(byte(s.version.Load()), cmd, 0)
 	f.data = bts
 
 	return s.writeFrame(f)
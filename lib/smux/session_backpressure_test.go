@@ -0,0 +1,61 @@
+package smux
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// blockingConn blocks every Write until gate is closed, and counts how
+// many Writes have started - including ones still blocked - so a test
+// can observe whether sendLoop let more requests reach doWrite/doWriteBatch
+// than its queue bound should allow.
+type blockingConn struct {
+	gate    chan struct{}
+	started int32
+}
+
+func (c *blockingConn) Read(b []byte) (int, error) { select {} }
+func (c *blockingConn) Write(b []byte) (int, error) {
+	atomic.AddInt32(&c.started, 1)
+	<-c.gate
+	return len(b), nil
+}
+func (c *blockingConn) Close() error { return nil }
+
+// TestSendLoopBackpressureBoundsQueueDepth checks that once sendLoop's
+// priority queue reaches Config.WriteRequestQueueSize, further writeFrame
+// callers block instead of growing the queue without bound.
+func TestSendLoopBackpressureBoundsQueueDepth(t *testing.T) {
+	config := DefaultConfig()
+	config.WriteRequestQueueSize = 2
+	conn := &blockingConn{gate: make(chan struct{})}
+	session := newSession(config, conn, false)
+	defer session.Close()
+
+	const producers = 10
+	done := make(chan struct{}, producers)
+	for i := 0; i < producers; i++ {
+		go func() {
+			session.writeFrame(newFrame(1, cmdNOP, 0))
+			done <- struct{}{}
+		}()
+	}
+
+	// let the writer pick up one request (blocking in conn.Write) and
+	// the rest pile up against the queue bound.
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) && atomic.LoadInt32(&conn.started) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	if got, max := atomic.LoadInt32(&conn.started), int32(config.WriteRequestQueueSize)+1; got > max {
+		t.Fatalf("conn.Write reached by %d requests before any completed, want at most %d (WriteRequestQueueSize+1 in-flight)", got, max)
+	}
+
+	close(conn.gate)
+	for i := 0; i < producers; i++ {
+		<-done
+	}
+}
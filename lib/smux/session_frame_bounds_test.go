@@ -0,0 +1,38 @@
+package smux
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// TestReadFrameRejectsOversizedLength checks that a v2 frame claiming a
+// length larger than the read buffer's capacity is rejected with an
+// error instead of panicking on an out-of-range slice expression - the
+// length field is peer-controlled and, unlike v1's uint16 field, v2's
+// uint32 field can claim far more than any reasonably sized buffer holds.
+func TestReadFrameRejectsOversizedLength(t *testing.T) {
+	config := DefaultConfig()
+	var hdr [headerSizeV2]byte
+	hdr[0] = 2 // ver
+	hdr[1] = cmdPSH
+	binary.LittleEndian.PutUint32(hdr[2:], uint32(config.MaxFrameSize+maxHeaderSize)+1) // length, more than the whole read buffer
+	binary.LittleEndian.PutUint32(hdr[6:], 1)                                           // sid
+
+	sess := &Session{config: config, MaxStreamBuffer: config.MaxStreamBuffer, die: make(chan struct{}), conn: &readOnlyConn{r: bytes.NewReader(hdr[:])}}
+
+	buffer := make([]byte, config.MaxFrameSize+maxHeaderSize)
+	if _, err := sess.readFrame(buffer); err == nil {
+		t.Fatalf("readFrame with an oversized length = nil error, want it rejected")
+	}
+}
+
+// readOnlyConn adapts a bytes.Reader into an io.ReadWriteCloser for
+// feeding readFrame a crafted byte stream.
+type readOnlyConn struct {
+	r *bytes.Reader
+}
+
+func (c *readOnlyConn) Read(b []byte) (int, error)  { return c.r.Read(b) }
+func (c *readOnlyConn) Write(b []byte) (int, error) { return len(b), nil }
+func (c *readOnlyConn) Close() error                { return nil }
@@ -0,0 +1,133 @@
+package smux
+
+import (
+	"io"
+	"net"
+	"testing"
+)
+
+func TestReorderingNegotiatesOnWhenBothSidesEnableIt(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	serverConfig := DefaultConfig()
+	serverConfig.EnableReordering = true
+
+	clientConfig := DefaultConfig()
+	clientConfig.EnableReordering = true
+
+	serverDone := make(chan *Session, 1)
+	go func() { serverDone <- newSession(serverConfig, c2, false) }()
+
+	client := newSession(clientConfig, c1, true)
+	defer client.Close()
+	server := <-serverDone
+	defer server.Close()
+
+	if !client.reordering.Load() {
+		t.Fatalf("client.reordering = false, want true when both sides enable it")
+	}
+	if !server.reordering.Load() {
+		t.Fatalf("server.reordering = false, want true when both sides enable it")
+	}
+}
+
+func TestReorderingStaysOffUnlessBothSidesEnableIt(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	serverConfig := DefaultConfig()
+	serverConfig.EnableReordering = false
+
+	clientConfig := DefaultConfig()
+	clientConfig.EnableReordering = true
+
+	serverDone := make(chan *Session, 1)
+	go func() { serverDone <- newSession(serverConfig, c2, false) }()
+
+	client := newSession(clientConfig, c1, true)
+	defer client.Close()
+	server := <-serverDone
+	defer server.Close()
+
+	if client.reordering.Load() {
+		t.Fatalf("client.reordering = true, want false when the server didn't request it")
+	}
+	if server.reordering.Load() {
+		t.Fatalf("server.reordering = true, want false when the server didn't request it")
+	}
+}
+
+func TestReorderingStaysOffBelowProtocolV2(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	serverConfig := DefaultConfig()
+	serverConfig.Version = 1
+	serverConfig.EnableReordering = true
+
+	clientConfig := DefaultConfig()
+	clientConfig.EnableReordering = true
+
+	serverDone := make(chan *Session, 1)
+	go func() { serverDone <- newSession(serverConfig, c2, false) }()
+
+	client := newSession(clientConfig, c1, true)
+	defer client.Close()
+	server := <-serverDone
+	defer server.Close()
+
+	if server.reordering.Load() {
+		t.Fatalf("server.reordering = true, want false when the negotiated version can't carry a seq field")
+	}
+	if client.reordering.Load() {
+		t.Fatalf("client.reordering = true, want false when the negotiated version can't carry a seq field")
+	}
+}
+
+// TestStreamPushSeqReassemblesOutOfOrderFrames exercises the reorder
+// buffer directly, since net.Pipe always delivers frames in order: it
+// feeds cmdPSH payloads to a Stream out of sequence and checks Read only
+// ever surfaces contiguous, correctly-ordered bytes.
+func TestStreamPushSeqReassemblesOutOfOrderFrames(t *testing.T) {
+	config := DefaultConfig()
+	sess := &Session{config: config, MaxStreamBuffer: config.MaxStreamBuffer, die: make(chan struct{})}
+	stream := newStream(1, config.MaxFrameSize, sess)
+
+	chunks := [][]byte{[]byte("AAAA"), []byte("BBBB"), []byte("CCCC"), []byte("DDDD")}
+
+	// deliver out of order: 2, 0, 3, 1
+	order := []int{2, 0, 3, 1}
+	for _, i := range order {
+		if err := stream.pushSeq(uint32(i), chunks[i]); err != nil {
+			t.Fatalf("pushSeq(%d): %v", i, err)
+		}
+	}
+
+	got := make([]byte, 16)
+	n, err := io.ReadFull(stream, got)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if want := "AAAABBBBCCCCDDDD"; string(got[:n]) != want {
+		t.Fatalf("reassembled data = %q, want %q", got[:n], want)
+	}
+}
+
+// TestStreamPushSeqReportsErrorOnExcessiveGap checks that buffering a
+// frame far enough ahead of the missing one to exceed MaxStreamBuffer is
+// reported as an error so the caller can tear the session down.
+func TestStreamPushSeqReportsErrorOnExcessiveGap(t *testing.T) {
+	config := DefaultConfig()
+	config.MaxStreamBuffer = 8
+	sess := &Session{config: config, MaxStreamBuffer: config.MaxStreamBuffer, die: make(chan struct{})}
+	stream := newStream(1, config.MaxFrameSize, sess)
+
+	// seq 0 never arrives; seq 1's payload alone already exceeds the cap
+	if err := stream.pushSeq(1, make([]byte, config.MaxStreamBuffer+1)); err != ErrReorderGap {
+		t.Fatalf("pushSeq with an oversized gap = %v, want ErrReorderGap", err)
+	}
+}
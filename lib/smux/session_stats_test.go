@@ -0,0 +1,50 @@
+package smux
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRTTAndStats(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	config := DefaultConfig()
+	config.KeepAliveInterval = 5 * time.Millisecond
+	config.KeepAliveTimeout = 50 * time.Millisecond
+	config.EnableStreamBuffer = true // ack cmdNOP so RTT samples arrive
+
+	serverDone := make(chan *Session, 1)
+	go func() { serverDone <- newSession(config, c2, false) }()
+
+	client := newSession(config, c1, true)
+	defer client.Close()
+	server := <-serverDone
+	defer server.Close()
+
+	// let a few cmdNOP/cmdACK round-trips happen. RTT and the FramesOut
+	// counter for the same ping are updated from different goroutines
+	// (recvLoop vs. the sendLoop writer), so poll for both together
+	// rather than assuming one implies the other has landed yet.
+	deadline := time.Now().Add(500 * time.Millisecond)
+	var stats SessionStats
+	for time.Now().Before(deadline) {
+		stats = client.Stats()
+		if stats.RTT > 0 && stats.FramesOut[cmdNOP] > 0 {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if stats.RTT <= 0 {
+		t.Fatalf("client RTT = %v, want a positive sample after several keepalive round-trips", stats.RTT)
+	}
+	if stats.FramesOut[cmdNOP] == 0 {
+		t.Fatalf("stats.FramesOut[cmdNOP] = 0, want at least one keepalive ping sent")
+	}
+	if stats.NumStreams != 0 {
+		t.Fatalf("stats.NumStreams = %d, want 0 with no open streams", stats.NumStreams)
+	}
+}
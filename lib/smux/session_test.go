@@ -0,0 +1,110 @@
+package smux
+
+import (
+	"io"
+	"net"
+	"sync"
+	"testing"
+)
+
+// discardConn is an in-memory io.ReadWriteCloser that throws away
+// everything written to it, used where a session just needs a cheap
+// conn to exist (e.g. exercising the handshake timeout path).
+type discardConn struct{}
+
+// Read blocks forever, like a peer that never answers: recvLoop treats
+// any Read error as a reason to tear the session down.
+func (discardConn) Read(b []byte) (int, error) {
+	select {}
+}
+func (discardConn) Write(b []byte) (int, error) { return len(b), nil }
+func (discardConn) Close() error                { return nil }
+
+// newLoopbackConn returns the client end of a connected
+// *net.TCPConn pair over loopback TCP whose server end discards
+// everything it reads. *net.TCPConn is the only widely
+// available io.Writer that actually takes net.Buffers.WriteTo's writev
+// fast path - that's an unexported interface net only satisfies
+// internally for real OS connections - so the batching benchmarks below
+// need a real socket, not an in-memory fake, to exercise what
+// doWriteBatch is meant to speed up.
+func newLoopbackConn(b *testing.B) net.Conn {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+
+	serverDone := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			b.Error(err)
+			return
+		}
+		serverDone <- conn
+	}()
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		b.Fatalf("dial: %v", err)
+	}
+	server := <-serverDone
+	b.Cleanup(func() { server.Close() })
+	go io.Copy(io.Discard, server)
+
+	return client
+}
+
+// benchmarkManySmallFrames drives writeFrame from concurrency goroutines
+// at once, so the sendLoop's priority queue actually builds up a backlog
+// for doWriteBatch's net.Buffers.WriteTo path to fold together - a single
+// synchronous caller never has more than one request queued, so it can
+// only ever exercise doWrite's one-syscall-per-frame path.
+func benchmarkManySmallFrames(b *testing.B, concurrency int) {
+	config := DefaultConfig()
+	// client: false skips the startup version handshake round-trip.
+	session := newSession(config, newLoopbackConn(b), false)
+	defer session.Close()
+
+	payload := make([]byte, 64)
+
+	perWorker := b.N / concurrency
+	if perWorker == 0 {
+		perWorker = 1
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	var wg sync.WaitGroup
+	wg.Add(concurrency)
+	for w := 0; w < concurrency; w++ {
+		go func() {
+			defer wg.Done()
+			for i := 0; i < perWorker; i++ {
+				f := newFrame(byte(session.version.Load()), cmdPSH, 1)
+				f.data = payload
+				session.writeFrame(f)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// BenchmarkSendLoopSingleWriter keeps only one writeFrame call in flight
+// at a time, so the priority queue never holds more than one request and
+// every frame goes out through doWrite's single-syscall path.
+func BenchmarkSendLoopSingleWriter(b *testing.B) {
+	benchmarkManySmallFrames(b, 1)
+}
+
+// BenchmarkSendLoopConcurrentWriters drives writeFrame from many
+// goroutines at once, so the priority queue backs up enough for
+// doWriteBatch to fold several frames into one writev(2) syscall via
+// net.Buffers.WriteTo. The gap over BenchmarkSendLoopSingleWriter widens
+// on multi-core machines, where producers genuinely run alongside the
+// writer instead of trading off a single core with it.
+func BenchmarkSendLoopConcurrentWriters(b *testing.B) {
+	benchmarkManySmallFrames(b, 64)
+}
@@ -0,0 +1,109 @@
+package smux
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestVersionNegotiationMatchingVersions(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	serverConfig := DefaultConfig()
+	clientConfig := DefaultConfig()
+
+	serverDone := make(chan *Session, 1)
+	go func() { serverDone <- newSession(serverConfig, c2, false) }()
+
+	client := newSession(clientConfig, c1, true)
+	defer client.Close()
+	server := <-serverDone
+	defer server.Close()
+
+	if client.version.Load() != maxVersion {
+		t.Fatalf("client negotiated version = %d, want %d", client.version.Load(), maxVersion)
+	}
+	if server.version.Load() != maxVersion {
+		t.Fatalf("server negotiated version = %d, want %d", server.version.Load(), maxVersion)
+	}
+}
+
+func TestVersionNegotiationDowngradesToOlderPeer(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	serverConfig := DefaultConfig()
+	serverConfig.Version = 1
+
+	clientConfig := DefaultConfig()
+	clientConfig.Version = maxVersion
+
+	serverDone := make(chan *Session, 1)
+	go func() { serverDone <- newSession(serverConfig, c2, false) }()
+
+	client := newSession(clientConfig, c1, true)
+	defer client.Close()
+	server := <-serverDone
+	defer server.Close()
+
+	if client.version.Load() != 1 {
+		t.Fatalf("client negotiated version = %d, want 1", client.version.Load())
+	}
+	if server.version.Load() != 1 {
+		t.Fatalf("server negotiated version = %d, want 1", server.version.Load())
+	}
+}
+
+// TestVersionRenegotiationIgnoredAfterHandshake checks that a cmdVER
+// arriving after the startup handshake has already completed - e.g. from
+// a confused or misbehaving peer - can't change the version/reordering a
+// session has already settled on and is encoding/decoding traffic with.
+func TestVersionRenegotiationIgnoredAfterHandshake(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	serverConfig := DefaultConfig()
+	clientConfig := DefaultConfig()
+	clientConfig.Version = 1
+
+	serverDone := make(chan *Session, 1)
+	go func() { serverDone <- newSession(serverConfig, c2, false) }()
+
+	client := newSession(clientConfig, c1, true)
+	defer client.Close()
+	server := <-serverDone
+	defer server.Close()
+
+	if server.version.Load() != 1 {
+		t.Fatalf("server negotiated version = %d, want 1", server.version.Load())
+	}
+
+	server.negotiatePeerVersion(maxVersion, true)
+
+	if server.version.Load() != 1 {
+		t.Fatalf("server version = %d after a late cmdVER, want the originally negotiated 1 unchanged", server.version.Load())
+	}
+	if server.reordering.Load() {
+		t.Fatalf("server.reordering = true after a late cmdVER, want the originally negotiated false unchanged")
+	}
+}
+
+func TestVersionNegotiationTimesOutAgainstSilentPeer(t *testing.T) {
+	config := DefaultConfig()
+	config.KeepAliveTimeout = 20 * time.Millisecond
+
+	start := time.Now()
+	client := newSession(config, discardConn{}, true)
+	defer client.Close()
+
+	if elapsed := time.Since(start); elapsed < config.KeepAliveTimeout {
+		t.Fatalf("negotiateVersion returned after %v, want to block at least %v", elapsed, config.KeepAliveTimeout)
+	}
+	if client.version.Load() != 1 {
+		t.Fatalf("client version = %d after a failed handshake, want the v1 fallback", client.version.Load())
+	}
+}
@@ -0,0 +1,51 @@
+package smux
+
+import (
+	"sync/atomic"
+	"testing"
+)
+
+// TestUpdatePeerWindowSurvivesWireWraparound exercises updatePeerWindow
+// once the true consumed count has passed 4GiB and wrapped the uint32
+// wire field back around near zero, checking that peerConsumed keeps
+// advancing in the full uint64 space instead of being compared against
+// (or overwritten with) the wrapped-small wire value directly.
+func TestUpdatePeerWindowSurvivesWireWraparound(t *testing.T) {
+	config := DefaultConfig()
+	sess := &Session{config: config, MaxStreamBuffer: config.MaxStreamBuffer, die: make(chan struct{})}
+	stream := newStream(1, config.MaxFrameSize, sess)
+
+	base := uint64(1)<<32 + 1000 // already past one wraparound
+	atomic.StoreUint64(&stream.numWritten, base+defaultStreamWindow)
+	atomic.StoreUint64(&stream.peerConsumed, base)
+
+	// the peer reports having consumed base+500, which on the wire is
+	// just the low 32 bits - here, (1000+500) mod 2^32, i.e. 1500.
+	wireConsumed := uint32(base + 500)
+	if err := stream.updatePeerWindow(newUpdateFrame(2, stream.id, wireConsumed, defaultStreamWindow).data); err != nil {
+		t.Fatalf("updatePeerWindow: %v", err)
+	}
+
+	if got, want := atomic.LoadUint64(&stream.peerConsumed), base+500; got != want {
+		t.Fatalf("peerConsumed = %d, want %d (wraparound not unwrapped correctly)", got, want)
+	}
+}
+
+// TestUpdatePeerWindowRejectsOverConsumption checks that a cmdUPD
+// claiming to have consumed more than we've ever written is still
+// rejected once unwrapped into the full uint64 space, not just compared
+// against the wrapped 32-bit wire value.
+func TestUpdatePeerWindowRejectsOverConsumption(t *testing.T) {
+	config := DefaultConfig()
+	sess := &Session{config: config, MaxStreamBuffer: config.MaxStreamBuffer, die: make(chan struct{})}
+	stream := newStream(1, config.MaxFrameSize, sess)
+
+	base := uint64(1)<<32 + 1000
+	atomic.StoreUint64(&stream.numWritten, base)
+	atomic.StoreUint64(&stream.peerConsumed, base-500)
+
+	wireConsumed := uint32(base + 500)
+	if err := stream.updatePeerWindow(newUpdateFrame(2, stream.id, wireConsumed, defaultStreamWindow).data); err != ErrConsumed {
+		t.Fatalf("updatePeerWindow over-consumption = %v, want ErrConsumed", err)
+	}
+}
@@ -0,0 +1,426 @@
+package smux
+
+import (
+	"bytes"
+	"container/heap"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var errTimeout = errors.New("i/o timeout")
+
+// ErrConsumed is returned (and the session torn down) when a peer's
+// cmdUPD claims to have consumed more bytes than we ever sent it
+var ErrConsumed = errors.New("smux: peer consumed more bytes than were sent")
+
+// ErrReorderGap is returned (and the session torn down) when a stream's
+// reorder buffer would have to grow past Session.MaxStreamBuffer to hold
+// a frame that arrived too far ahead of the one it's still waiting for
+var ErrReorderGap = errors.New("smux: reorder buffer exceeded waiting for a missing frame")
+
+// defaultStreamWindow is the sliding-window size advertised to the peer,
+// and the smallest window we assume the peer has until its first cmdUPD
+// arrives (Session.initialPeerWindow may assume a larger one). Protocol
+// v2+ only; see Session.version.
+const defaultStreamWindow = 256 * 1024
+
+// Stream implements io.ReadWriteCloser
+type Stream struct {
+	id uint32
+
+	sess *Session
+
+	buffer  bytes.Buffer
+	bufferLock sync.Mutex
+
+	frameSize int
+
+	// FIN
+	die     chan struct{}
+	dieLock sync.Mutex
+
+	// RST from peer, read side can no longer be trusted
+	rst int32
+
+	chReadEvent chan struct{}
+
+	// pauseWrite/resumeWrite, driven by peer cmdFUL/cmdEMP (protocol v1)
+	paused int32
+
+	// sliding-window flow control (protocol v2+, see Session.version)
+	numRead        uint64 // total bytes delivered to the caller via Read
+	numWritten     uint64 // total bytes handed off to writeFrame via Write
+	lastUpdateSent uint64 // numRead as of the last cmdUPD we sent
+	peerConsumed   uint64 // bytes the peer has told us (via cmdUPD) it has drained
+	peerWindow     uint32 // bytes the peer currently says it can accept
+	chUpdate       chan struct{}
+
+	// per-frame sequencing and reassembly (protocol v2+ with
+	// Config.EnableReordering, see Session.reordering)
+	sendSeq     uint32    // next seq to stamp on an outgoing cmdPSH frame
+	expectSeq   uint32    // next seq pushSeq needs before it can deliver more
+	reorderHeap seqHeap   // cmdPSH payloads buffered ahead of expectSeq
+	reorderSize int       // total bytes currently held in reorderHeap
+
+	deadline atomic.Value
+}
+
+// newStream initiates a Stream struct
+func newStream(id uint32, frameSize int, sess *Session) *Stream {
+	s := new(Stream)
+	s.id = id
+	s.chReadEvent = make(chan struct{}, 1)
+	s.frameSize = frameSize
+	s.sess = sess
+	s.die = make(chan struct{})
+	s.peerWindow = sess.initialPeerWindow()
+	s.chUpdate = make(chan struct{}, 1)
+	return s
+}
+
+// ID returns the unique stream id
+func (s *Stream) ID() uint32 {
+	return s.id
+}
+
+// Read implements io.Reader
+func (s *Stream) Read(b []byte) (n int, err error) {
+	var deadline <-chan time.Time
+	if d, ok := s.deadline.Load().(time.Time); ok && !d.IsZero() {
+		timer := time.NewTimer(d.Sub(time.Now()))
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	for {
+		s.bufferLock.Lock()
+		n, err = s.buffer.Read(b)
+		s.bufferLock.Unlock()
+
+		if n > 0 {
+			s.sess.returnTokens(n)
+			atomic.AddUint64(&s.numRead, uint64(n))
+			s.maybeSendUpdate()
+			return n, nil
+		}
+
+		if atomic.LoadInt32(&s.rst) > 0 {
+			return 0, io.EOF
+		}
+
+		select {
+		case <-s.chReadEvent:
+			continue
+		case <-deadline:
+			return 0, errTimeout
+		case <-s.die:
+			return 0, io.EOF
+		}
+	}
+}
+
+// Write implements io.Writer
+func (s *Stream) Write(b []byte) (n int, err error) {
+	select {
+	case <-s.die:
+		return 0, errors.New(errBrokenPipe)
+	default:
+	}
+
+	var deadline <-chan time.Time
+	if d, ok := s.deadline.Load().(time.Time); ok && !d.IsZero() {
+		timer := time.NewTimer(d.Sub(time.Now()))
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	negotiatedVer := s.sess.version.Load()
+	useWindow := negotiatedVer >= 2
+
+	// s.frameSize comes from Config.MaxFrameSize, which may be set above
+	// what protocol v1's uint16 wire length field can hold if the peer
+	// negotiated the session down to v1 after the fact; clamp the chunk
+	// size so a frame's length never silently truncates on the wire.
+	frameSize := s.frameSize
+	if negotiatedVer < 2 && frameSize > 65535 {
+		frameSize = 65535
+	}
+	frames := bytesToFrames(b, s.id, frameSize, byte(negotiatedVer))
+	for _, f := range frames {
+		if s.sess.reordering.Load() {
+			f.seq = atomic.AddUint32(&s.sendSeq, 1) - 1
+		}
+		if useWindow {
+			if err := s.waitWindow(len(f.data), deadline); err != nil {
+				return n, err
+			}
+		} else {
+			// cooperatively wait while the peer's receive buffer is full
+		pause:
+			for atomic.LoadInt32(&s.paused) > 0 {
+				select {
+				case <-s.die:
+					return n, errors.New(errBrokenPipe)
+				case <-time.After(s.sess.BoostTimeout):
+					break pause
+				}
+			}
+		}
+
+		if _, err := s.sess.writeFrame(f); err != nil {
+			return n, err
+		}
+		if useWindow {
+			atomic.AddUint64(&s.numWritten, uint64(len(f.data)))
+		}
+		n += len(f.data)
+	}
+	return n, nil
+}
+
+// waitWindow blocks until the peer's advertised window has room for sz
+// more unacknowledged bytes, honoring the stream's write deadline. It
+// wakes as soon as a cmdUPD from the peer advances peerConsumed/peerWindow.
+func (s *Stream) waitWindow(sz int, deadline <-chan time.Time) error {
+	for {
+		written := atomic.LoadUint64(&s.numWritten)
+		consumed := atomic.LoadUint64(&s.peerConsumed)
+		window := uint64(atomic.LoadUint32(&s.peerWindow))
+		if written-consumed+uint64(sz) <= window {
+			return nil
+		}
+
+		select {
+		case <-s.chUpdate:
+		case <-deadline:
+			return errTimeout
+		case <-s.die:
+			return errors.New(errBrokenPipe)
+		}
+	}
+}
+
+// maybeSendUpdate reports how much we've drained back to the peer once
+// protocol v2's sliding-window flow control is active and consumption
+// has advanced by more than half the advertised window since the last
+// cmdUPD, so the peer can keep writing without stalling on a stale window.
+func (s *Stream) maybeSendUpdate() {
+	if s.sess.version.Load() < 2 {
+		return
+	}
+
+	numRead := atomic.LoadUint64(&s.numRead)
+	last := atomic.LoadUint64(&s.lastUpdateSent)
+	if numRead-last <= defaultStreamWindow/2 {
+		return
+	}
+	if !atomic.CompareAndSwapUint64(&s.lastUpdateSent, last, numRead) {
+		return
+	}
+
+	s.sess.writeFrameInternal(newUpdateFrame(byte(s.sess.version.Load()), s.id, uint32(numRead), uint32(defaultStreamWindow)), prioControl)
+}
+
+// updatePeerWindow applies a cmdUPD frame received from the peer and
+// wakes any Write blocked on window space.
+//
+// consumed is carried on the wire as a uint32, but numWritten (what it's
+// compared against) is a uint64 that keeps counting past 4GiB of stream
+// traffic, so the wire value can't be compared or stored directly once
+// it's wrapped: extendWireCounter unwraps it against the last consumed
+// value we saw before either side of the comparison happens.
+func (s *Stream) updatePeerWindow(data []byte) error {
+	if len(data) < 8 {
+		return nil
+	}
+	consumedWire := binary.LittleEndian.Uint32(data[0:])
+	window := binary.LittleEndian.Uint32(data[4:])
+
+	prevConsumed := atomic.LoadUint64(&s.peerConsumed)
+	consumed := extendWireCounter(prevConsumed, consumedWire)
+	if consumed < prevConsumed {
+		// a stale/duplicate update that arrived out of order; the peer
+		// never reports less consumed than it already has
+		return nil
+	}
+
+	if consumed > atomic.LoadUint64(&s.numWritten) {
+		return ErrConsumed
+	}
+
+	atomic.StoreUint64(&s.peerConsumed, consumed)
+	atomic.StoreUint32(&s.peerWindow, window)
+
+	select {
+	case s.chUpdate <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// extendWireCounter unwraps a uint32 wire counter (e.g. cmdUPD's consumed
+// field) back into the uint64 space its sender is actually counting in,
+// by picking the 64-bit value nearest prev whose low 32 bits equal wire -
+// the same signed-difference trick TCP uses to compare sequence numbers
+// across a wraparound. It only produces the right answer if the true
+// counter hasn't advanced (or gone stale) by more than 1<<31 since prev,
+// which for a per-stream byte counter wrapping every 4GiB is not a
+// realistic amount of reordering or delay to see in one update.
+func extendWireCounter(prev uint64, wire uint32) uint64 {
+	diff := int32(wire - uint32(prev))
+	return uint64(int64(prev) + int64(diff))
+}
+
+func bytesToFrames(b []byte, sid uint32, frameSize int, ver byte) []Frame {
+	var frames []Frame
+	for len(b) > 0 {
+		sz := len(b)
+		if sz > frameSize {
+			sz = frameSize
+		}
+		f := newFrame(ver, cmdPSH, sid)
+		f.data = b[:sz]
+		frames = append(frames, f)
+		b = b[sz:]
+	}
+	return frames
+}
+
+// Close implements io.Closer
+func (s *Stream) Close() error {
+	s.dieLock.Lock()
+	select {
+	case <-s.die:
+		s.dieLock.Unlock()
+		return errors.New(errBrokenPipe)
+	default:
+		close(s.die)
+		s.dieLock.Unlock()
+		s.sess.streamClosed(s.id)
+		_, err := s.sess.writeFrame(newFrame(byte(s.sess.version.Load()), cmdFIN, s.id))
+		return err
+	}
+}
+
+// SetDeadline sets the read/write deadline for the stream
+func (s *Stream) SetDeadline(t time.Time) error {
+	s.deadline.Store(t)
+	return nil
+}
+
+// session closes the stream without sending a cmdFIN, used when the
+// session itself is tearing down
+func (s *Stream) sessionClose() {
+	s.dieLock.Lock()
+	defer s.dieLock.Unlock()
+	select {
+	case <-s.die:
+	default:
+		close(s.die)
+	}
+}
+
+// markRST marks this stream has received a RST (cmdFIN) from the peer
+func (s *Stream) markRST() {
+	atomic.StoreInt32(&s.rst, 1)
+}
+
+// pauseWrite is called by the session when the peer reports cmdFUL
+func (s *Stream) pauseWrite() {
+	atomic.StoreInt32(&s.paused, 1)
+}
+
+// resumeWrite is called by the session when the peer reports cmdEMP
+func (s *Stream) resumeWrite() {
+	atomic.StoreInt32(&s.paused, 0)
+}
+
+// pushBytes appends received data to the read buffer
+func (s *Stream) pushBytes(data []byte) {
+	s.bufferLock.Lock()
+	s.buffer.Write(data)
+	s.bufferLock.Unlock()
+}
+
+// seqChunk is one out-of-order cmdPSH payload held in a Stream's
+// reorderHeap until the frames it's waiting on arrive
+type seqChunk struct {
+	seq  uint32
+	data []byte
+}
+
+// seqHeap is a container/heap min-heap of seqChunks, ordered by seq, so
+// pushSeq can always check the lowest pending seq against expectSeq
+type seqHeap []seqChunk
+
+func (h seqHeap) Len() int            { return len(h) }
+func (h seqHeap) Less(i, j int) bool  { return h[i].seq < h[j].seq }
+func (h seqHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *seqHeap) Push(x interface{}) { *h = append(*h, x.(seqChunk)) }
+func (h *seqHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	*h = old[:n-1]
+	return item
+}
+
+// pushSeq delivers a received cmdPSH payload to the read buffer in seq
+// order, buffering it in reorderHeap if it arrived ahead of expectSeq and
+// draining any now-contiguous run once the gap is filled. It returns
+// ErrReorderGap if holding this frame would grow the reorder buffer past
+// the stream's MaxStreamBuffer, which the caller treats as fatal for the
+// session: there's no way to recover a dropped frame without a resend
+// mechanism this protocol doesn't have.
+func (s *Stream) pushSeq(seq uint32, data []byte) error {
+	s.bufferLock.Lock()
+	defer s.bufferLock.Unlock()
+
+	if seq == s.expectSeq {
+		s.buffer.Write(data)
+		s.expectSeq++
+		for len(s.reorderHeap) > 0 && s.reorderHeap[0].seq == s.expectSeq {
+			chunk := heap.Pop(&s.reorderHeap).(seqChunk)
+			s.buffer.Write(chunk.data)
+			s.reorderSize -= len(chunk.data)
+			s.expectSeq++
+		}
+		return nil
+	}
+
+	if seq < s.expectSeq {
+		// a duplicate of a frame we've already delivered; drop it
+		return nil
+	}
+
+	if s.reorderSize+len(data) > s.sess.MaxStreamBuffer {
+		return ErrReorderGap
+	}
+
+	buffered := make([]byte, len(data))
+	copy(buffered, data)
+	heap.Push(&s.reorderHeap, seqChunk{seq: seq, data: buffered})
+	s.reorderSize += len(buffered)
+	return nil
+}
+
+// notifyReadEvent wakes up a blocked Read
+func (s *Stream) notifyReadEvent() {
+	select {
+	case s.chReadEvent <- struct{}{}:
+	default:
+	}
+}
+
+// recycleTokens returns the number of buffered-but-unread bytes so the
+// session can credit them back to the token bucket when the stream closes
+func (s *Stream) recycleTokens() (n int) {
+	s.bufferLock.Lock()
+	n = s.buffer.Len()
+	s.bufferLock.Unlock()
+	return
+}